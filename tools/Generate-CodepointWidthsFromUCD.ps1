@@ -14,6 +14,35 @@
 # developed for use with the CodepointWidthDetector, which has some override
 # ranges.
 #
+# The header of the generated table records the Unicode version, parsed from the
+# UCD's description, on a "Unicode-Version:" line and in s_unicodeVersion.
+#
+# East Asian Ambiguous codepoints are emitted with isAmbiguous set, leaving the
+# decision to CodepointWidthDetector's fallback method at runtime. Supply
+# -Ambiguous Narrow or -Ambiguous Wide to resolve them at generation time
+# instead (for instance, to produce a table for CJK locales).
+#
+# The header of the generated table records when it was generated. To make the
+# output reproducible, either set SOURCE_DATE_EPOCH[3] or supply -NoTimestamp.
+#
+# Unrecognized East_Asian_Width values are fatal by default. Supply -Lenient to
+# instead treat the affected codepoints as narrow and get one warning per value,
+# so that a newer UCD can still be processed before this script learns about it.
+#
+# Supply -CoverageComment to summarize, per Unicode plane, how many codepoints
+# the table classifies as wide, ambiguous and narrow in the generated header.
+# Reserved codepoints count toward whatever width the UCD gives them (the CJK
+# blocks and planes 2 and 3 are wide even where unassigned).
+#
+# Supply -Format Csv to emit the full codepoint-to-width mapping (including the
+# narrow ranges that the C++ table omits) as Start,End,Width rows instead. The
+# CSV has no header comment, so -NoTimestamp has no effect on it, and switches
+# that only add to the C++ output (-CoverageComment, -TableHash) are rejected.
+#
+# Supply -TableHash to record a SHA-256 of the table's contents, both in the
+# header and as s_tableHash. It only covers the ranges themselves (not comments,
+# formatting or the timestamp), so it changes if and only if the data does.
+#
 # This script was developed against the flat "no han unification" UCD
 # "ucd.nounihan.flat.xml".
 # It does not support the grouped database format.
@@ -25,6 +54,7 @@
 #
 # [1]: https://www.unicode.org/Public/UCD/latest/ucdxml/
 # [2]: https://www.unicode.org/reports/tr42/
+# [3]: https://reproducible-builds.org/specs/source-date-epoch/
 
 [Diagnostics.CodeAnalysis.SuppressMessageAttribute('PSAvoidUsingPositionalParameters', '')]
 [Diagnostics.CodeAnalysis.SuppressMessageAttribute('PSUseProcessBlockForPipelineCommand', '')]
@@ -42,8 +72,18 @@ Param(
     [Parameter(Position=1, ValueFromPipelineByPropertyName=$true, ParameterSetName="Unparsed")]
     [string]$OverridePath = "overrides.xml",
 
+    [ValidateSet("Cpp", "Csv")]
+    [string]$Format = "Cpp", # Emit a C++ table body or a CSV of width ranges
+
+    [ValidateSet("Narrow", "Wide")]
+    [string]$Ambiguous, # Resolve East Asian Ambiguous codepoints to this width
+
     [switch]$Pack, # Pack tightly based on width
-    [switch]$NoOverrides # Do not include overrides
+    [switch]$NoOverrides, # Do not include overrides
+    [switch]$Lenient, # Warn about (rather than reject) unknown property values
+    [switch]$CoverageComment, # Include per-plane width statistics in the header
+    [switch]$TableHash, # Include a SHA-256 of the table data
+    [switch]$NoTimestamp # Do not include the generation date
 )
 
 Enum CodepointWidth {
@@ -53,15 +93,47 @@ Enum CodepointWidth {
 }
 
 # UCD Functions {{{
+Function ConvertFrom-UCDCodepoint($hex) {
+    # Returns nothing (rather than throwing) for garbage, so that callers can report the offending entry
+    If ($hex -notmatch '^[0-9A-Fa-f]+$') {
+        Return
+    }
+    If ($hex.TrimStart('0').Length -gt 8) {
+        # Too long for [long] to hold safely, but still well past U+10FFFF
+        [long]::MaxValue
+        Return
+    }
+    [long]$cp = 0
+    [void][long]::TryParse($hex, [System.Globalization.NumberStyles]::AllowHexSpecifier, [System.Globalization.CultureInfo]::InvariantCulture, [ref]$cp)
+    $cp
+}
+
 Function Get-UCDEntryRange($entry) {
-    $s = $e = 0
-    if ($null -ne $v.cp) {
+    if ($null -ne $entry.cp) {
         # Individual Codepoint
-        $s = $e = [int]("0x"+$v.cp)
-    } ElseIf ($null -ne $v."first-cp") {
+        $first = $last = $entry.cp
+    } ElseIf ($null -ne $entry."first-cp") {
         # Range of Codepoints
-        $s = [int]("0x"+$v."first-cp")
-        $e = [int]("0x"+$v."last-cp")
+        If ($null -eq $entry."last-cp") {
+            throw ("<{0}> range starting at U+{1} has no last-cp" -f $entry.LocalName, $entry."first-cp")
+        }
+        $first = $entry."first-cp"
+        $last = $entry."last-cp"
+    } Else {
+        throw ("<{0}> has neither cp nor first-cp" -f $entry.LocalName)
+    }
+    $s = ConvertFrom-UCDCodepoint $first
+    $e = ConvertFrom-UCDCodepoint $last
+
+    # Don't let malformed data silently produce ranges CodepointWidthDetector can never match
+    If ($null -eq $s -or $null -eq $e) {
+        throw ("Codepoint range U+{0}..U+{1} is not hexadecimal" -f $first, $last)
+    }
+    If ($s -gt 0x10FFFF -or $e -gt 0x10FFFF) {
+        throw ("Codepoint range U+{0}..U+{1} is outside of U+0000..U+10FFFF" -f $first, $last)
+    }
+    If ($s -gt $e) {
+        throw ("Codepoint range U+{0}..U+{1} is reversed" -f $first, $last)
     }
     $s
     $e
@@ -79,20 +151,42 @@ Function Get-UCDEntryWidth($entry) {
         "H"  { [CodepointWidth]::Narrow; Return }
         "W"  { [CodepointWidth]::Wide; Return }
         "F"  { [CodepointWidth]::Wide; Return }
-        "A"  { [CodepointWidth]::Ambiguous; Return }
-        default { throw "Unexpected East_Asian_Width property" }
+        "A"  {
+            If ($script:Ambiguous) {
+                # The caller asked for a locale-specific table; bake the decision in
+                [CodepointWidth]$script:Ambiguous; Return
+            }
+            [CodepointWidth]::Ambiguous; Return
+        }
+        default {
+            If ($script:Lenient) {
+                # The flat UCD has an entry per codepoint, so collect these and report each value once
+                $s, $e = Get-UCDEntryRange $entry
+                $unknown = $script:UnknownWidths["$($entry.ea)"]
+                If ($null -eq $unknown) {
+                    $unknown = $script:UnknownWidths["$($entry.ea)"] = [System.Collections.Generic.List[Object]]::New()
+                }
+                $unknown.Add([pscustomobject]@{ Start = $s; End = $e })
+                [CodepointWidth]::Narrow; Return
+            }
+            throw "Unexpected East_Asian_Width property"
+        }
     }
 }
 
-Function Get-UCDEntryFlags($entry) {
+Function Get-UCDEntryFlags($entry, [CodepointWidth]$width) {
     If ($script:Pack) {
         # If we're "pack"ing entries, only the computed width matters for telling them apart
-        Get-UCDEntryWidth $entry
+        $width
         Return
     }
 
     $normalizedEAWidth = $entry.ea
     $normalizedEAWidth = $normalizedEAWidth -eq "F" ? "W" : $normalizedEAWidth;
+    If ($script:Ambiguous -and $normalizedEAWidth -eq "A") {
+        # -Ambiguous resolved these, so let them merge with the ranges they now look like
+        $normalizedEAWidth = $script:Ambiguous -eq "Wide" ? "W" : "N"
+    }
     "{0}{1}{2}" -f $normalizedEAWidth, $entry.Emoji, $entry.EPres
 }
 # }}}
@@ -107,7 +201,7 @@ Class UnicodeRange : System.IComparable {
     UnicodeRange([System.Xml.XmlElement]$ucdEntry) {
         $this.Start, $this.End = Get-UCDEntryRange $ucdEntry
         $this.Width = Get-UCDEntryWidth $ucdEntry
-        $this.Flags = Get-UCDEntryFlags $ucdEntry
+        $this.Flags = Get-UCDEntryFlags $ucdEntry $this.Width
 
         If (-not $script:Pack -and $ucdEntry.Emoji -eq "Y" -and $ucdEntry.EPres -eq "Y") {
             $this.Comment = "Emoji=Y EPres=Y"
@@ -208,6 +302,12 @@ Class UnicodeRangeList : System.Collections.Generic.List[Object] {
     }
 }
 
+If ($Format -eq "Csv" -and ($CoverageComment -or $TableHash)) {
+    throw "-CoverageComment and -TableHash only apply to -Format Cpp"
+}
+
+$UnknownWidths = @{} # Unrecognized East_Asian_Width value -> affected ranges (see -Lenient)
+
 # Ingest UCD
 If ($null -eq $InputObject) {
     $InputObject = [xml](Get-Content $Path)
@@ -215,10 +315,11 @@ If ($null -eq $InputObject) {
 
 $UCDRepertoire = $InputObject.ucd.repertoire.ChildNodes | Sort-Object {
     # Sort by either cp or first-cp (for ranges)
+    # (malformed values sort as $null and are reported by Get-UCDEntryRange)
     if ($null -ne $_.cp) {
-        [int]("0x"+$_.cp)
+        ConvertFrom-UCDCodepoint $_.cp
     } ElseIf ($null -ne $_."first-cp") {
-        [int]("0x"+$_."first-cp")
+        ConvertFrom-UCDCodepoint $_."first-cp"
     }
 }
 
@@ -248,6 +349,40 @@ If (-not $NoOverrides) {
     }
 }
 
+ForEach($value in ($UnknownWidths.Keys | Sort-Object)) {
+    $spans = [System.Collections.Generic.List[Object]]::New()
+    ForEach($r in ($UnknownWidths[$value] | Sort-Object Start)) {
+        If ($spans.Count -gt 0 -and ($r.Start - $spans[$spans.Count - 1].End) -le 1) {
+            $spans[$spans.Count - 1].End = [Math]::Max($spans[$spans.Count - 1].End, $r.End)
+            Continue
+        }
+        $spans.Add([pscustomobject]@{ Start = $r.Start; End = $r.End })
+    }
+    $list = ForEach($_ in $spans) {
+        $_.Start -eq $_.End ? ("U+{0:X4}" -f $_.Start) : ("U+{0:X4}..U+{1:X4}" -f $_.Start, $_.End)
+    }
+    Write-Warning ("Unexpected East_Asian_Width property '{0}' on {1}; treated as narrow" -f $value, ($list -join ", "))
+}
+
+If ($Format -eq "Csv") {
+    # The CSV only carries widths, so coalesce on that alone (ignoring flags and comments)
+    $rows = [System.Collections.Generic.List[Object]]::New($ranges.Count)
+    ForEach($_ in $ranges) {
+        If ($rows.Count -gt 0) {
+            $last = $rows[$rows.Count - 1]
+            If ($last.Width -eq $_.Width -and ($_.Start - $last.End) -le 1) {
+                $last.End = $_.End
+                Continue
+            }
+        }
+        $rows.Add([pscustomobject]@{ Start = $_.Start; End = $_.End; Width = $_.Width })
+    }
+    $rows | ForEach-Object {
+        [pscustomobject]@{ Start = "0x{0:x}" -f $_.Start; End = "0x{0:x}" -f $_.End; Width = $_.Width }
+    } | ConvertTo-Csv -UseQuotes AsNeeded
+    Return
+}
+
 $ranges.RemoveAll({ $args[0].Width -eq [CodepointWidth]::Narrow }) | Out-Null
 
 $c = 0
@@ -255,14 +390,73 @@ ForEach($_ in $ranges) {
     $c += $_.End - $_.Start + 1
 }
 
+# The description reads like "Unicode 15.0.0"; pull out a token that tooling can parse
+$unicodeVersion = "unknown"
+If ($InputObject.ucd.description -match '\d+\.\d+\.\d+') {
+    $unicodeVersion = $Matches[0]
+} Else {
+    Write-Warning ("Could not find a Unicode version in the UCD description '{0}'" -f $InputObject.ucd.description)
+}
+
 # Emit Code
-"    // Generated by {0} -Pack:{1} -Full:{2} -NoOverrides:{3}" -f $MyInvocation.MyCommand.Name, $Pack, $Full, $NoOverrides
-"    // on {0} from {1}." -f (Get-Date -AsUTC -Format "u"), $InputObject.ucd.description
+$generatedBy = "    // Generated by {0} -Pack:{1} -Full:{2} -NoOverrides:{3}" -f $MyInvocation.MyCommand.Name, $Pack, $Full, $NoOverrides
+If ($Ambiguous) {
+    # Only recorded when given, so that regenerating the default table doesn't produce a diff
+    $generatedBy += " -Ambiguous:{0}" -f $Ambiguous
+}
+If ($Lenient) {
+    $generatedBy += " -Lenient:{0}" -f $Lenient
+}
+$generatedBy
+If ($NoTimestamp) {
+"    // from {0}." -f $InputObject.ucd.description
+} Else {
+    $timestamp = Get-Date -AsUTC
+    If ($env:SOURCE_DATE_EPOCH) {
+        $timestamp = [DateTimeOffset]::FromUnixTimeSeconds([long]$env:SOURCE_DATE_EPOCH).UtcDateTime
+    }
+"    // on {0} from {1}." -f $timestamp.ToString("u"), $InputObject.ucd.description
+}
+"    // Unicode-Version: {0}" -f $unicodeVersion
 "    // {0} (0x{0:X}) codepoints covered." -f $c
 If (-not $NoOverrides) {
 "    // {0} (0x{0:X}) codepoints overridden." -f $overrideCount
 "    // Override path: {0}" -f $OverridePath
 }
+If ($CoverageComment) {
+    $wideByPlane = [int[]]::new(17)
+    $ambiguousByPlane = [int[]]::new(17)
+    ForEach($_ in $ranges) {
+        # Nothing prevents a range from straddling a plane boundary, so split it up
+        For ($plane = $_.Start -shr 16; $plane -le ($_.End -shr 16); $plane++) {
+            $n = [Math]::Min($_.End, ($plane -shl 16) + 0xFFFF) - [Math]::Max($_.Start, $plane -shl 16) + 1
+            If ($_.Width -eq [CodepointWidth]::Ambiguous) {
+                $ambiguousByPlane[$plane] += $n
+            } Else {
+                $wideByPlane[$plane] += $n
+            }
+        }
+    }
+"    // Coverage by plane (assigned and reserved codepoints alike; narrow is the remainder):"
+    For ($plane = 0; $plane -lt 17; $plane++) {
+        If ($wideByPlane[$plane] + $ambiguousByPlane[$plane] -eq 0) {
+            Continue
+        }
+"    //   Plane {0,2}: {1} wide, {2} ambiguous, {3} narrow" -f $plane, $wideByPlane[$plane], $ambiguousByPlane[$plane], (0x10000 - $wideByPlane[$plane] - $ambiguousByPlane[$plane])
+    }
+}
+If ($TableHash) {
+    $rows = ForEach($_ in $ranges) {
+        "{0:x},{1:x},{2}" -f $_.Start, $_.End, [int]($_.Width -eq [CodepointWidth]::Ambiguous)
+    }
+    $hash = [System.Security.Cryptography.SHA256]::HashData([System.Text.Encoding]::UTF8.GetBytes($rows -join "`n"))
+    $tableHash = [System.Convert]::ToHexString($hash).ToLowerInvariant()
+"    // Table-SHA256: {0}" -f $tableHash
+}
+"    static constexpr std::string_view s_unicodeVersion{{ ""{0}"" }};" -f $unicodeVersion
+If ($TableHash) {
+"    static constexpr std::string_view s_tableHash{{ ""{0}"" }};" -f $tableHash
+}
 "    static constexpr std::array<UnicodeRange, {0}> s_wideAndAmbiguousTable{{" -f $ranges.Count
 ForEach($_ in $ranges) {
     $isAmbiguous = $_.Width -eq [CodepointWidth]::Ambiguous